@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sashabaranov/go-openai"
+)
+
+// Embedder abstracts away the embedding provider so the server can be pointed
+// at a self-hosted model (Ollama, llama.cpp) instead of a paid API, or swap in
+// a domain-tuned embedder, without recompiling.
+type Embedder interface {
+	// Embed returns one vector per input text, in the same order, plus the
+	// number of tokens billed for the call (for mcp_tokens_billed_total).
+	// Providers whose API reports exact usage (OpenAI) return it as-is;
+	// providers that don't report it estimate it the same way splitIntoChunks does.
+	Embed(ctx context.Context, texts []string) (vectors [][]float32, tokensUsed int, err error)
+	// Dimensions is the length of the vectors this embedder produces.
+	Dimensions() int
+	// Name identifies the provider, for logging and metrics.
+	Name() string
+}
+
+// estimateTokens approximates billed tokens for providers whose API doesn't
+// report real usage, using the same tokens-per-word ratio splitIntoChunks
+// uses for chunk sizing.
+func estimateTokens(texts []string) int {
+	words := 0
+	for _, t := range texts {
+		words += len(strings.Fields(t))
+	}
+	return int(float64(words) * approxTokensPerWord)
+}
+
+// newEmbedderFromEnv selects an Embedder implementation based on the
+// EMBEDDING_PROVIDER env var (default "openai"). aiClient is reused for the
+// "openai" provider so we don't construct a second client with the same token.
+func newEmbedderFromEnv(aiClient *openai.Client) (Embedder, error) {
+	provider := os.Getenv("EMBEDDING_PROVIDER")
+	if provider == "" {
+		provider = "openai"
+	}
+
+	switch provider {
+	case "openai":
+		return &openAIEmbedder{client: aiClient, model: openai.SmallEmbedding3, dimensions: 1536}, nil
+	case "cohere":
+		apiKey := os.Getenv("COHERE_API_KEY")
+		if apiKey == "" {
+			return nil, fmt.Errorf("COHERE_API_KEY is required when EMBEDDING_PROVIDER=cohere")
+		}
+		return &cohereEmbedder{apiKey: apiKey, model: "embed-english-v3.0", dimensions: 1024, httpClient: &http.Client{Timeout: 30 * time.Second}}, nil
+	case "voyage":
+		apiKey := os.Getenv("VOYAGE_API_KEY")
+		if apiKey == "" {
+			return nil, fmt.Errorf("VOYAGE_API_KEY is required when EMBEDDING_PROVIDER=voyage")
+		}
+		return &voyageEmbedder{apiKey: apiKey, model: "voyage-3", dimensions: 1024, httpClient: &http.Client{Timeout: 30 * time.Second}}, nil
+	case "ollama":
+		baseURL := os.Getenv("OLLAMA_BASE_URL")
+		if baseURL == "" {
+			baseURL = "http://localhost:11434"
+		}
+		model := os.Getenv("OLLAMA_EMBEDDING_MODEL")
+		if model == "" {
+			model = "nomic-embed-text"
+		}
+		dims, err := ollamaDimensions()
+		if err != nil {
+			return nil, err
+		}
+		return &ollamaEmbedder{baseURL: baseURL, model: model, dimensions: dims, httpClient: &http.Client{Timeout: 60 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown EMBEDDING_PROVIDER %q: must be one of openai, cohere, voyage, ollama", provider)
+	}
+}
+
+// ollamaDimensions reads OLLAMA_EMBEDDING_DIMENSIONS since the dimension of a
+// locally-served model can't be discovered without an extra round trip, and
+// we need it up front to validate against the documents.embedding column.
+func ollamaDimensions() (int, error) {
+	raw := os.Getenv("OLLAMA_EMBEDDING_DIMENSIONS")
+	if raw == "" {
+		return 0, fmt.Errorf("OLLAMA_EMBEDDING_DIMENSIONS is required when EMBEDDING_PROVIDER=ollama")
+	}
+	var dims int
+	if _, err := fmt.Sscanf(raw, "%d", &dims); err != nil || dims <= 0 {
+		return 0, fmt.Errorf("OLLAMA_EMBEDDING_DIMENSIONS must be a positive integer, got %q", raw)
+	}
+	return dims, nil
+}
+
+// openAIEmbedder wraps the existing go-openai client.
+type openAIEmbedder struct {
+	client     *openai.Client
+	model      openai.EmbeddingModel
+	dimensions int
+}
+
+func (e *openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, int, error) {
+	resp, err := e.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{Input: texts, Model: e.model})
+	if err != nil {
+		return nil, 0, err
+	}
+	out := make([][]float32, len(resp.Data))
+	for i, d := range resp.Data {
+		out[i] = d.Embedding
+	}
+	return out, resp.Usage.TotalTokens, nil
+}
+
+func (e *openAIEmbedder) Dimensions() int { return e.dimensions }
+func (e *openAIEmbedder) Name() string    { return "openai/" + string(e.model) }
+
+// cohereEmbedder calls Cohere's /v1/embed endpoint.
+type cohereEmbedder struct {
+	apiKey     string
+	model      string
+	dimensions int
+	httpClient *http.Client
+}
+
+func (e *cohereEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, int, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model":      e.model,
+		"texts":      texts,
+		"input_type": "search_document",
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.cohere.com/v1/embed", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cohere embed request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("cohere embed returned %d: %s", resp.StatusCode, string(b))
+	}
+
+	var parsed struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, 0, fmt.Errorf("decoding cohere response: %w", err)
+	}
+	// Cohere's embed response doesn't report token usage, so estimate it.
+	return parsed.Embeddings, estimateTokens(texts), nil
+}
+
+func (e *cohereEmbedder) Dimensions() int { return e.dimensions }
+func (e *cohereEmbedder) Name() string    { return "cohere/" + e.model }
+
+// voyageEmbedder calls Voyage AI's /v1/embeddings endpoint.
+type voyageEmbedder struct {
+	apiKey     string
+	model      string
+	dimensions int
+	httpClient *http.Client
+}
+
+func (e *voyageEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, int, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model": e.model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.voyageai.com/v1/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("voyage embed request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("voyage embed returned %d: %s", resp.StatusCode, string(b))
+	}
+
+	var parsed struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, 0, fmt.Errorf("decoding voyage response: %w", err)
+	}
+	out := make([][]float32, len(parsed.Data))
+	for i, d := range parsed.Data {
+		out[i] = d.Embedding
+	}
+	tokensUsed := parsed.Usage.TotalTokens
+	if tokensUsed == 0 {
+		tokensUsed = estimateTokens(texts)
+	}
+	return out, tokensUsed, nil
+}
+
+func (e *voyageEmbedder) Dimensions() int { return e.dimensions }
+func (e *voyageEmbedder) Name() string    { return "voyage/" + e.model }
+
+// ollamaEmbedder calls a local Ollama (or llama.cpp-compatible) server's
+// /api/embeddings endpoint. Older Ollama versions only embed one input at a
+// time, so we issue one request per text rather than assuming batch support.
+type ollamaEmbedder struct {
+	baseURL    string
+	model      string
+	dimensions int
+	httpClient *http.Client
+}
+
+func (e *ollamaEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, int, error) {
+	out := make([][]float32, len(texts))
+	for i, text := range texts {
+		body, err := json.Marshal(map[string]interface{}{
+			"model":  e.model,
+			"prompt": text,
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.baseURL+"/api/embeddings", bytes.NewReader(body))
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := e.httpClient.Do(req)
+		if err != nil {
+			return nil, 0, fmt.Errorf("ollama embed request failed: %w", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("ollama embed returned %d: %s", resp.StatusCode, string(b))
+		}
+
+		var parsed struct {
+			Embedding []float32 `json:"embedding"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&parsed)
+		resp.Body.Close()
+		if err != nil {
+			return nil, 0, fmt.Errorf("decoding ollama response: %w", err)
+		}
+		out[i] = parsed.Embedding
+	}
+	// Ollama's /api/embeddings response doesn't report token usage either.
+	return out, estimateTokens(texts), nil
+}
+
+func (e *ollamaEmbedder) Dimensions() int { return e.dimensions }
+func (e *ollamaEmbedder) Name() string    { return "ollama/" + e.model }
+
+// validateEmbedderDimensions fails fast at startup if the configured
+// embedder's output dimension doesn't match the documents.embedding column,
+// rather than letting every search request fail with an opaque pgvector error.
+func validateEmbedderDimensions(ctx context.Context, pool *pgxpool.Pool, embedder Embedder) error {
+	const sqlColumnDimensions = `
+		SELECT atttypmod
+		FROM pg_attribute
+		WHERE attrelid = 'documents'::regclass
+		  AND attname = 'embedding'
+		  AND NOT attisdropped`
+
+	var columnDimensions int
+	if err := pool.QueryRow(ctx, sqlColumnDimensions).Scan(&columnDimensions); err != nil {
+		return fmt.Errorf("looking up documents.embedding dimension: %w", err)
+	}
+
+	if columnDimensions != embedder.Dimensions() {
+		return fmt.Errorf("embedder %q produces %d-dimensional vectors but documents.embedding is declared as vector(%d); run a migration or change EMBEDDING_PROVIDER",
+			embedder.Name(), embedder.Dimensions(), columnDimensions)
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/pgvector/pgvector-go"
+)
+
+// Chunking targets, in tokens. We approximate token count with a simple
+// words-per-token ratio rather than pulling in a tokenizer, which is close
+// enough for chunk sizing and keeps this dependency-free.
+const (
+	parentChunkTokens   = 1500
+	childChunkTokens    = 300
+	childChunkOverlap   = 50
+	approxTokensPerWord = 0.75 // ~0.75 tokens per word, i.e. ~1.33 words/token
+)
+
+// registerIngestTools wires up rag-upsert and rag-delete, which let MCP
+// clients write into the knowledge base instead of only querying rows an
+// external ingestion job already populated.
+func registerIngestTools(s mcpServer, pool *pgxpool.Pool, embedder Embedder, limiter *tenantRateLimiter) {
+	upsertTool := mcp.NewTool("rag-upsert",
+		mcp.WithDescription("Ingest a document into the knowledge base, chunking it into parent/child rows with embeddings."),
+		mcp.WithString("source_url",
+			mcp.Required(),
+			mcp.Description("Stable identifier for the document, used to find and replace it on re-ingestion."),
+		),
+		mcp.WithString("title",
+			mcp.Description("Document title, stored on the parent row's metadata."),
+		),
+		mcp.WithString("content",
+			mcp.Description("The full document content to chunk and embed. Ignored if 'blocks' is provided."),
+		),
+		mcp.WithArray("blocks",
+			mcp.Description("Notion-block-aware alternative to 'content': an ordered list of {id, text} objects, one per Notion block. Each block's own id is carried through as anchor_block_id on its child chunks, instead of a single anchor shared by the whole document."),
+		),
+		mcp.WithObject("metadata",
+			mcp.Description("Additional metadata to merge into every chunk (e.g. notion_page_id, anchor_block_id, url)."),
+		),
+		mcp.WithString("tenant_id",
+			mcp.Description("The Tenant ID (UUID). Required if not provided by the HTTP transport's verified bearer token (e.g. in stdio mode)."),
+		),
+	)
+
+	s.AddTool(upsertTool, instrumentTool("rag-upsert", func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		sourceURL, err := request.RequireString("source_url")
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		content := request.GetString("content", "")
+		blocks := notionBlocksFromRequest(request)
+		if content == "" && len(blocks) == 0 {
+			return mcp.NewToolResultError("Either 'content' or 'blocks' is required."), nil
+		}
+		title := request.GetString("title", "")
+
+		tenantID := tenantIDFromRequest(ctx, request)
+		if tenantID == "" {
+			return mcp.NewToolResultError("Unauthorized: Missing tenant_id. Must be provided via a verified bearer token or the 'tenant_id' argument."), nil
+		}
+
+		baseMetadata, _ := request.GetArguments()["metadata"].(map[string]interface{})
+		if baseMetadata == nil {
+			baseMetadata = map[string]interface{}{}
+		}
+		baseMetadata["title"] = title
+		baseMetadata["url"] = sourceURL
+
+		plans := planChunks(content, blocks)
+
+		// Embed every parent's children up front, before opening a transaction,
+		// so a synchronous embedding-provider HTTP call never holds one of the
+		// pool's connections idle. childVectors[i] is nil when plans[i] has no
+		// children.
+		childVectors := make([][][]float32, len(plans))
+		for i, plan := range plans {
+			if len(plan.Children) == 0 {
+				continue
+			}
+
+			childTexts := make([]string, len(plan.Children))
+			for j, c := range plan.Children {
+				childTexts[j] = c.Text
+			}
+
+			// Same budget/metric path as rag-search's query embedding: ingestion
+			// embeds are still embedding-provider calls billed against the tenant's daily
+			// embedding budget, not a free side door around it.
+			if !limiter.consumeEmbeddingBudget(tenantID, time.Now().Format("2006-01-02")) {
+				return mcp.NewToolResultError(embeddingBudgetError(tenantID).Error()), nil
+			}
+
+			embedCtx, embedSpan := tracer.Start(ctx, "embedding.generate")
+			embedStart := time.Now()
+			vectors, tokensUsed, err := embedder.Embed(embedCtx, childTexts)
+			embeddingLatencySeconds.WithLabelValues(embedder.Name()).Observe(time.Since(embedStart).Seconds())
+			embedSpan.End()
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Failed to embed child chunks: %v", err)), nil
+			}
+			embeddingsCalledTotal.WithLabelValues(tenantID).Inc()
+			tokensBilledTotal.WithLabelValues(tenantID).Add(float64(tokensUsed))
+
+			childVectors[i] = vectors
+		}
+
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to begin transaction: %v", err)), nil
+		}
+		defer tx.Rollback(ctx)
+
+		// Scope this transaction to tenantID so the documents RLS policy backs
+		// up the WHERE tenant_id = ... clauses below.
+		if _, err := tx.Exec(ctx, `SELECT set_config('app.tenant_id', $1, true)`, tenantID); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to set tenant context: %v", err)), nil
+		}
+
+		// Replace any prior ingestion of this source_url atomically: children
+		// cascade via ON DELETE CASCADE on documents.parent_id.
+		if _, err := tx.Exec(ctx, `DELETE FROM documents WHERE tenant_id = $1 AND metadata->>'url' = $2 AND doc_type = 'parent'`, tenantID, sourceURL); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to clear prior ingestion: %v", err)), nil
+		}
+
+		parentCount, childCount := 0, 0
+		for i, plan := range plans {
+			parentMetadata := cloneMetadata(baseMetadata)
+			parentMetadataJSON, err := json.Marshal(parentMetadata)
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Failed to marshal parent metadata: %v", err)), nil
+			}
+
+			var parentID string
+			err = tx.QueryRow(ctx,
+				`INSERT INTO documents (tenant_id, doc_type, content, metadata) VALUES ($1, 'parent', $2, $3) RETURNING id`,
+				tenantID, plan.ParentText, parentMetadataJSON,
+			).Scan(&parentID)
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Failed to insert parent chunk: %v", err)), nil
+			}
+			parentCount++
+
+			if len(plan.Children) == 0 {
+				continue
+			}
+			vectors := childVectors[i]
+
+			for j, c := range plan.Children {
+				childMetadata := cloneMetadata(baseMetadata)
+				// The block's own anchor wins over whatever anchor_block_id the
+				// caller put in the shared metadata, so each child's deep link
+				// still points at the Notion block it actually came from.
+				if c.AnchorBlockID != "" {
+					childMetadata["anchor_block_id"] = c.AnchorBlockID
+				}
+				childMetadataJSON, err := json.Marshal(childMetadata)
+				if err != nil {
+					return mcp.NewToolResultError(fmt.Sprintf("Failed to marshal child metadata: %v", err)), nil
+				}
+
+				if _, err := tx.Exec(ctx,
+					`INSERT INTO documents (tenant_id, doc_type, content, metadata, parent_id, embedding) VALUES ($1, 'child', $2, $3, $4, $5)`,
+					tenantID, c.Text, childMetadataJSON, parentID, pgvector.NewVector(vectors[j]),
+				); err != nil {
+					return mcp.NewToolResultError(fmt.Sprintf("Failed to insert child chunk: %v", err)), nil
+				}
+				childCount++
+			}
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to commit ingestion: %v", err)), nil
+		}
+
+		return mcp.NewToolResultText(fmt.Sprintf("Ingested %q: %d parent chunk(s), %d child chunk(s).", sourceURL, parentCount, childCount)), nil
+	}))
+
+	deleteTool := mcp.NewTool("rag-delete",
+		mcp.WithDescription("Delete a document (and its child chunks) from the knowledge base."),
+		mcp.WithString("source_url",
+			mcp.Description("Delete all chunks ingested from this source_url. Either this or document_id is required."),
+		),
+		mcp.WithString("document_id",
+			mcp.Description("Delete a single parent document by ID (cascades to its children). Either this or source_url is required."),
+		),
+		mcp.WithString("tenant_id",
+			mcp.Description("The Tenant ID (UUID). Required if not provided by the HTTP transport's verified bearer token (e.g. in stdio mode)."),
+		),
+	)
+
+	s.AddTool(deleteTool, instrumentTool("rag-delete", func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		tenantID := tenantIDFromRequest(ctx, request)
+		if tenantID == "" {
+			return mcp.NewToolResultError("Unauthorized: Missing tenant_id. Must be provided via a verified bearer token or the 'tenant_id' argument."), nil
+		}
+
+		sourceURL := request.GetString("source_url", "")
+		documentID := request.GetString("document_id", "")
+		if sourceURL == "" && documentID == "" {
+			return mcp.NewToolResultError("Either 'source_url' or 'document_id' is required."), nil
+		}
+
+		var rowsAffected int64
+		err := withTenantTx(ctx, pool, tenantID, func(tx pgx.Tx) error {
+			var tag pgconn.CommandTag
+			var err error
+			if documentID != "" {
+				tag, err = tx.Exec(ctx, `DELETE FROM documents WHERE tenant_id = $1 AND id = $2 AND doc_type = 'parent'`, tenantID, documentID)
+			} else {
+				tag, err = tx.Exec(ctx, `DELETE FROM documents WHERE tenant_id = $1 AND metadata->>'url' = $2 AND doc_type = 'parent'`, tenantID, sourceURL)
+			}
+			if err != nil {
+				return err
+			}
+			rowsAffected = tag.RowsAffected()
+			return nil
+		})
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Delete failed: %v", err)), nil
+		}
+
+		return mcp.NewToolResultText(fmt.Sprintf("Deleted %d document(s).", rowsAffected)), nil
+	}))
+}
+
+// tenantIDFromRequest applies the same precedence as rag-search: the
+// authenticated context (HTTP transport) wins over a caller-supplied
+// argument (needed for stdio, which has no HTTP middleware).
+func tenantIDFromRequest(ctx context.Context, request mcp.CallToolRequest) string {
+	if tenantID, ok := ctx.Value(TenantIDKey).(string); ok && tenantID != "" {
+		return tenantID
+	}
+	return request.GetString("tenant_id", "")
+}
+
+func cloneMetadata(m map[string]interface{}) map[string]interface{} {
+	clone := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		clone[k] = v
+	}
+	return clone
+}
+
+// splitIntoChunks splits text into word-boundary chunks of roughly
+// targetTokens each, with roughly overlapTokens tokens' worth of words repeated
+// at the start of each chunk after the first. It's a plain word-count splitter: good enough for
+// parent/child sizing without needing the real tokenizer the embedding model uses.
+func splitIntoChunks(text string, targetTokens int, overlapTokens int) []string {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return nil
+	}
+
+	wordsPerChunk := int(float64(targetTokens) / approxTokensPerWord)
+	overlapWords := int(float64(overlapTokens) / approxTokensPerWord)
+	if wordsPerChunk <= overlapWords {
+		wordsPerChunk = overlapWords + 1
+	}
+
+	var chunks []string
+	for start := 0; start < len(words); {
+		end := start + wordsPerChunk
+		if end > len(words) {
+			end = len(words)
+		}
+		chunks = append(chunks, strings.Join(words[start:end], " "))
+		if end == len(words) {
+			break
+		}
+		start = end - overlapWords
+	}
+	return chunks
+}
+
+// notionBlock is one unit of Notion content with its own stable ID, which
+// rag-search's deep links key off of (hit.Metadata["anchor_block_id"]).
+type notionBlock struct {
+	ID   string
+	Text string
+}
+
+// notionBlocksFromRequest parses the optional 'blocks' argument into
+// notionBlocks, skipping entries missing a usable 'text'.
+func notionBlocksFromRequest(request mcp.CallToolRequest) []notionBlock {
+	raw, _ := request.GetArguments()["blocks"].([]interface{})
+	blocks := make([]notionBlock, 0, len(raw))
+	for _, entry := range raw {
+		m, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		text, _ := m["text"].(string)
+		if text == "" {
+			continue
+		}
+		id, _ := m["id"].(string)
+		blocks = append(blocks, notionBlock{ID: id, Text: text})
+	}
+	return blocks
+}
+
+// childChunkPlan is one to-be-embedded child chunk and the anchor_block_id
+// its metadata should carry (empty means "inherit whatever the caller put in
+// the shared metadata", for non-block-aware ingestion).
+type childChunkPlan struct {
+	Text          string
+	AnchorBlockID string
+}
+
+// chunkPlan is one parent row plus the child rows that should hang off it.
+type chunkPlan struct {
+	ParentText string
+	Children   []childChunkPlan
+}
+
+// planChunks builds the parent/child chunk plan for rag-upsert. If blocks is
+// non-empty it uses the Notion-block-aware path: parents group whole blocks
+// up to ~parentChunkTokens, and each block's own children all carry that
+// block's own anchor_block_id, so a multi-block document's deep links still
+// resolve per-chunk instead of all pointing at one caller-supplied anchor.
+// Otherwise it falls back to the plain word-count splitter on content.
+func planChunks(content string, blocks []notionBlock) []chunkPlan {
+	if len(blocks) == 0 {
+		parents := splitIntoChunks(content, parentChunkTokens, 0)
+		plans := make([]chunkPlan, 0, len(parents))
+		for _, parentText := range parents {
+			children := splitIntoChunks(parentText, childChunkTokens, childChunkOverlap)
+			childPlans := make([]childChunkPlan, len(children))
+			for i, childText := range children {
+				childPlans[i] = childChunkPlan{Text: childText}
+			}
+			plans = append(plans, chunkPlan{ParentText: parentText, Children: childPlans})
+		}
+		return plans
+	}
+
+	plans := make([]chunkPlan, 0, len(blocks))
+	for _, group := range groupBlocksForParents(blocks, parentChunkTokens) {
+		blockTexts := make([]string, len(group))
+		var childPlans []childChunkPlan
+		for i, b := range group {
+			blockTexts[i] = b.Text
+			for _, childText := range splitIntoChunks(b.Text, childChunkTokens, childChunkOverlap) {
+				childPlans = append(childPlans, childChunkPlan{Text: childText, AnchorBlockID: b.ID})
+			}
+		}
+		plans = append(plans, chunkPlan{ParentText: strings.Join(blockTexts, "\n\n"), Children: childPlans})
+	}
+	return plans
+}
+
+// groupBlocksForParents greedily packs consecutive blocks into ~targetTokens
+// groups without splitting a single block across two parents, so a block's
+// anchor_block_id is never shared with content that landed under a different
+// parent.
+func groupBlocksForParents(blocks []notionBlock, targetTokens int) [][]notionBlock {
+	var groups [][]notionBlock
+	var current []notionBlock
+	currentTokens := 0
+
+	for _, b := range blocks {
+		blockTokens := int(float64(len(strings.Fields(b.Text))) * approxTokensPerWord)
+		if len(current) > 0 && currentTokens+blockTokens > targetTokens {
+			groups = append(groups, current)
+			current = nil
+			currentTokens = 0
+		}
+		current = append(current, b)
+		currentTokens += blockTokens
+	}
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+	return groups
+}
+
+// mcpServer is the subset of *server.MCPServer that registerIngestTools
+// needs, so tests can pass a fake in place of a real server.
+type mcpServer interface {
+	AddTool(tool mcp.Tool, handler server.ToolHandlerFunc)
+}
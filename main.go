@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,6 +18,7 @@ import (
 	"github.com/mark3labs/mcp-go/server"
 	"github.com/pgvector/pgvector-go"
 	pgxvector "github.com/pgvector/pgvector-go/pgx"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sashabaranov/go-openai"
 )
 
@@ -27,10 +29,72 @@ const (
 	TenantIDKey ContextKey = "tenantID"
 )
 
+// rrfK is the Reciprocal Rank Fusion smoothing constant (score = 1/(k+rank)).
+// k=60 is the value from the original RRF paper and works well without tuning;
+// set RRF_K to override it.
+var rrfK = 60
+
+// rrfKFromEnv reads RRF_K, falling back to the paper's k=60 default if unset
+// or not a positive integer.
+func rrfKFromEnv() int {
+	raw := os.Getenv("RRF_K")
+	if raw == "" {
+		return rrfK
+	}
+	var k int
+	if _, err := fmt.Sscanf(raw, "%d", &k); err != nil || k <= 0 {
+		log.Printf("Warning: RRF_K=%q is not a positive integer, using default %d", raw, rrfK)
+		return rrfK
+	}
+	return k
+}
+
+// vectorCandidateLimit returns how many rows to pull per retrieval source before
+// fusion. Over-fetching relative to the requested limit gives RRF enough of each
+// ranking to actually move results, rather than just re-sorting the same top-N.
+func vectorCandidateLimit(limit int) int {
+	candidates := limit * 4
+	if candidates < 20 {
+		candidates = 20
+	}
+	return candidates
+}
+
+// sensitiveHeaderNames are redacted before request headers are logged —
+// Authorization now carries a bearer JWT with the caller's tenant claim, and
+// Cookie/X-Api-Key are equally credential-bearing if a future auth scheme adds them.
+var sensitiveHeaderNames = []string{"Authorization", "Cookie", "X-Api-Key"}
+
+// redactedHeaders returns a copy of h with sensitiveHeaderNames replaced by a
+// fixed placeholder, safe to pass to log.Printf.
+func redactedHeaders(h http.Header) http.Header {
+	redacted := h.Clone()
+	for _, name := range sensitiveHeaderNames {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, "[REDACTED]")
+		}
+	}
+	return redacted
+}
+
 func main() {
 	transport := flag.String("transport", "http", "Transport mode: 'http' or 'stdio'")
 	flag.Parse()
 
+	rrfK = rrfKFromEnv()
+
+	// Set up OTel tracing. A no-op shutdown is returned if
+	// OTEL_EXPORTER_OTLP_ENDPOINT isn't configured.
+	otelShutdown, err := setupOTel(context.Background())
+	if err != nil {
+		log.Fatalf("Unable to set up OpenTelemetry: %v", err)
+	}
+	defer func() {
+		if err := otelShutdown(context.Background()); err != nil {
+			log.Printf("Error shutting down OpenTelemetry: %v", err)
+		}
+	}()
+
 	// Initialize Database Connection
 	dbURL := os.Getenv("SUPABASE_DB_URL")
 	if dbURL == "" {
@@ -54,10 +118,12 @@ func main() {
 	dbConfig.MaxConnLifetime = 1 * time.Hour
 	dbConfig.MaxConnIdleTime = 30 * time.Minute
 
-	// Register pgvector types
+	// Register pgvector types and wire pgx's tracer interface to OTel/Prometheus
+	// so slow SQL shows up both in traces and in mcp_db_query_latency_seconds.
 	dbConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
 		return pgxvector.RegisterTypes(ctx, conn)
 	}
+	dbConfig.ConnConfig.Tracer = &otelQueryTracer{}
 
 	pool, err := pgxpool.NewWithConfig(context.Background(), dbConfig)
 	if err != nil {
@@ -72,6 +138,36 @@ func main() {
 	}
 	aiClient := openai.NewClient(openAIToken)
 
+	// Initialize the embeddings provider. Defaults to OpenAI but can be swapped
+	// for a self-hosted or domain-tuned embedder via EMBEDDING_PROVIDER.
+	embedder, err := newEmbedderFromEnv(aiClient)
+	if err != nil {
+		log.Fatalf("Unable to initialize embedder: %v", err)
+	}
+	if err := validateEmbedderDimensions(context.Background(), pool, embedder); err != nil {
+		log.Fatalf("Embedder misconfigured: %v", err)
+	}
+	log.Printf("Using embedding provider: %s", embedder.Name())
+
+	// Initialize the (optional) cross-encoder reranker. Reranking is opt-in
+	// per request via the 'rerank' tool parameter, so a missing provider is
+	// only an error once a caller actually asks for it.
+	reranker, err := newRerankerFromEnv()
+	if err != nil {
+		log.Fatalf("Reranker misconfigured: %v", err)
+	}
+	if reranker != nil {
+		log.Printf("Using reranker: %s", reranker.Name())
+	}
+
+	// Per-tenant rate limiting + daily embedding budget, refreshed from the
+	// tenant_limits table.
+	limiter := newTenantRateLimiter(pool)
+	refreshCtx, cancelRefresh := context.WithCancel(context.Background())
+	defer cancelRefresh()
+	go limiter.refreshLoop(refreshCtx)
+	go pollPoolStats(refreshCtx, pool)
+
 	// Create MCP Server
 	s := server.NewMCPServer(
 		"Supabase RAG Server",
@@ -94,10 +190,22 @@ func main() {
 		mcp.WithString("tenant_id",
 			mcp.Description("The Tenant ID (UUID). Required if not provided via X-Tenant-ID header (e.g. in stdio mode)."),
 		),
+		mcp.WithString("mode",
+			mcp.Description("Retrieval mode: 'vector', 'lexical', or 'hybrid' (default: 'hybrid')."),
+		),
+		mcp.WithNumber("alpha",
+			mcp.Description("Weight given to the vector score when mode is 'hybrid', in [0,1] (default: 0.5). Lexical score gets (1-alpha)."),
+		),
+		mcp.WithBoolean("rerank",
+			mcp.Description("Apply a cross-encoder reranking pass before truncating to 'limit' (default: false). Requires RERANKER_PROVIDER to be configured."),
+		),
+		mcp.WithNumber("rerank_top_k",
+			mcp.Description("How many fused candidates to send to the reranker before truncating to 'limit' (default: 20)."),
+		),
 	)
 
 	// Add Tool Handler
-	s.AddTool(ragTool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	s.AddTool(ragTool, instrumentTool("rag-search", func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		// Extract arguments
 		query, err := request.RequireString("query")
 		if err != nil {
@@ -120,63 +228,218 @@ func main() {
 			return mcp.NewToolResultError("Unauthorized: Missing tenant_id. Must be provided via X-Tenant-ID header or 'tenant_id' argument."), nil
 		}
 
-		// A. Generate Embedding for the query
-		embReq := openai.EmbeddingRequest{
-			Input: []string{query},
-			Model: openai.SmallEmbedding3,
+		mode := request.GetString("mode", "hybrid")
+		switch mode {
+		case "vector", "lexical", "hybrid":
+		default:
+			return mcp.NewToolResultError(fmt.Sprintf("Invalid mode %q: must be 'vector', 'lexical', or 'hybrid'.", mode)), nil
 		}
-		embResp, err := aiClient.CreateEmbeddings(ctx, embReq)
-		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("Failed to generate embedding: %v", err)), nil
+
+		alpha := request.GetFloat("alpha", 0.5)
+		if alpha < 0 || alpha > 1 {
+			return mcp.NewToolResultError("Invalid alpha: must be between 0 and 1."), nil
+		}
+
+		searchesServedTotal.WithLabelValues(tenantID).Inc()
+
+		// A. Generate Embedding for the query (skipped in pure lexical mode)
+		var vector []float32
+		if mode != "lexical" {
+			if !limiter.consumeEmbeddingBudget(tenantID, time.Now().Format("2006-01-02")) {
+				return mcp.NewToolResultError(embeddingBudgetError(tenantID).Error()), nil
+			}
+
+			embedCtx, embedSpan := tracer.Start(ctx, "embedding.generate")
+			embedStart := time.Now()
+			vectors, tokensUsed, err := embedder.Embed(embedCtx, []string{query})
+			embeddingLatencySeconds.WithLabelValues(embedder.Name()).Observe(time.Since(embedStart).Seconds())
+			embedSpan.End()
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Failed to generate embedding: %v", err)), nil
+			}
+			embeddingsCalledTotal.WithLabelValues(tenantID).Inc()
+			tokensBilledTotal.WithLabelValues(tenantID).Add(float64(tokensUsed))
+			vector = vectors[0]
 		}
-		vector := embResp.Data[0].Embedding
-
-		// B. Vector Search — query child documents only
-		sqlSearch := `
-			SELECT id, content, metadata, parent_id,
-			       embedding <=> $2 AS distance
-			FROM documents
-			WHERE tenant_id = $1
-			  AND doc_type = 'child'
-			ORDER BY embedding <=> $2
-			LIMIT $3`
 
 		type ChildHit struct {
 			ID       string
 			Content  string
 			Metadata map[string]interface{}
 			ParentID string
-			Distance float64
+			Score    float64
 		}
 
-		rows, err := pool.Query(ctx, sqlSearch, tenantID, pgvector.NewVector(vector), limit)
+		// B. Retrieve candidates — query child documents only, per requested mode.
+		// Vector and lexical candidates are fetched independently so they can be
+		// fused with Reciprocal Rank Fusion: score = sum(1 / (rrfK + rank)).
+		// Both queries run inside one transaction scoped to tenantID via
+		// withTenantTx: the documents RLS policy is the backstop if the
+		// WHERE tenant_id = $1 clauses below are ever wrong or missing.
+		candidates := make(map[string]*ChildHit)
+		rankOf := make(map[string]map[string]int) // source -> id -> rank (1-based)
+
+		err = withTenantTx(ctx, pool, tenantID, func(tx pgx.Tx) error {
+			if mode == "vector" || mode == "hybrid" {
+				vectorCtx, vectorSpan := tracer.Start(ctx, "db.vector_search")
+				defer vectorSpan.End()
+
+				sqlVector := `
+					SELECT id, content, metadata, parent_id
+					FROM documents
+					WHERE tenant_id = $1
+					  AND doc_type = 'child'
+					ORDER BY embedding <=> $2
+					LIMIT $3`
+
+				rows, err := tx.Query(vectorCtx, sqlVector, tenantID, pgvector.NewVector(vector), vectorCandidateLimit(limit))
+				if err != nil {
+					return fmt.Errorf("vector search failed: %w", err)
+				}
+				ranks := make(map[string]int)
+				rank := 0
+				for rows.Next() {
+					var h ChildHit
+					var metadataJSON []byte
+					if err := rows.Scan(&h.ID, &h.Content, &metadataJSON, &h.ParentID); err != nil {
+						log.Printf("Error scanning vector hit: %v", err)
+						continue
+					}
+					if err := json.Unmarshal(metadataJSON, &h.Metadata); err != nil {
+						log.Printf("Error parsing metadata for child %s: %v", h.ID, err)
+						continue
+					}
+					rank++
+					ranks[h.ID] = rank
+					if _, exists := candidates[h.ID]; !exists {
+						candidates[h.ID] = &h
+					}
+				}
+				rows.Close()
+				rankOf["vector"] = ranks
+			}
+
+			if mode == "lexical" || mode == "hybrid" {
+				lexicalCtx, lexicalSpan := tracer.Start(ctx, "db.lexical_search")
+				defer lexicalSpan.End()
+
+				sqlLexical := `
+					SELECT id, content, metadata, parent_id
+					FROM documents
+					WHERE tenant_id = $1
+					  AND doc_type = 'child'
+					  AND tsv @@ websearch_to_tsquery('english', $2)
+					ORDER BY ts_rank_cd(tsv, websearch_to_tsquery('english', $2)) DESC
+					LIMIT $3`
+
+				rows, err := tx.Query(lexicalCtx, sqlLexical, tenantID, query, vectorCandidateLimit(limit))
+				if err != nil {
+					return fmt.Errorf("lexical search failed: %w", err)
+				}
+				ranks := make(map[string]int)
+				rank := 0
+				for rows.Next() {
+					var h ChildHit
+					var metadataJSON []byte
+					if err := rows.Scan(&h.ID, &h.Content, &metadataJSON, &h.ParentID); err != nil {
+						log.Printf("Error scanning lexical hit: %v", err)
+						continue
+					}
+					if err := json.Unmarshal(metadataJSON, &h.Metadata); err != nil {
+						log.Printf("Error parsing metadata for child %s: %v", h.ID, err)
+						continue
+					}
+					rank++
+					ranks[h.ID] = rank
+					if _, exists := candidates[h.ID]; !exists {
+						candidates[h.ID] = &h
+					}
+				}
+				rows.Close()
+				rankOf["lexical"] = ranks
+			}
+
+			return nil
+		})
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("Database query failed: %v", err)), nil
+			return mcp.NewToolResultError(err.Error()), nil
 		}
-		defer rows.Close()
-
-		var hits []ChildHit
-		for rows.Next() {
-			var h ChildHit
-			var metadataJSON []byte
-			if err := rows.Scan(&h.ID, &h.Content, &metadataJSON, &h.ParentID, &h.Distance); err != nil {
-				log.Printf("Error scanning child row: %v", err)
-				continue
+
+		if len(candidates) == 0 {
+			return mcp.NewToolResultText("No relevant documents found."), nil
+		}
+
+		// C. Fuse per mode. Hybrid combines both rankings with weighted RRF;
+		// single-source modes just use that source's own rank.
+		for id, h := range candidates {
+			var score float64
+			switch mode {
+			case "vector":
+				if r, ok := rankOf["vector"][id]; ok {
+					score = 1 / float64(rrfK+r)
+				}
+			case "lexical":
+				if r, ok := rankOf["lexical"][id]; ok {
+					score = 1 / float64(rrfK+r)
+				}
+			case "hybrid":
+				if r, ok := rankOf["vector"][id]; ok {
+					score += alpha * (1 / float64(rrfK+r))
+				}
+				if r, ok := rankOf["lexical"][id]; ok {
+					score += (1 - alpha) * (1 / float64(rrfK+r))
+				}
 			}
-			// Parse JSONB metadata
-			if err := json.Unmarshal(metadataJSON, &h.Metadata); err != nil {
-				log.Printf("Error parsing metadata for child %s: %v", h.ID, err)
-				continue
+			h.Score = score
+		}
+
+		hits := make([]ChildHit, 0, len(candidates))
+		for _, h := range candidates {
+			hits = append(hits, *h)
+		}
+		sort.Slice(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+
+		// C2. Optional cross-encoder reranking pass. Runs on the fused top-K
+		// (wider than `limit`) and re-scores each candidate against the raw
+		// query text, which catches cases where cosine/RRF ranks a
+		// superficially-similar chunk above the one that actually answers it.
+		doRerank := request.GetBool("rerank", false)
+		if doRerank {
+			if reranker == nil {
+				return mcp.NewToolResultError("rerank was requested but no RERANKER_PROVIDER is configured on the server."), nil
+			}
+
+			rerankTopK := request.GetInt("rerank_top_k", 20)
+			if rerankTopK <= 0 {
+				rerankTopK = 20
+			}
+			if rerankTopK > len(hits) {
+				rerankTopK = len(hits)
+			}
+			rerankCandidates := hits[:rerankTopK]
+
+			documents := make([]string, len(rerankCandidates))
+			for i, h := range rerankCandidates {
+				documents[i] = h.Content
+			}
+
+			scores, err := reranker.Rerank(ctx, query, documents)
+			if err != nil {
+				return mcp.NewToolResultError(fmt.Sprintf("Reranking failed: %v", err)), nil
+			}
+			for i := range rerankCandidates {
+				rerankCandidates[i].Score = scores[i]
 			}
-			hits = append(hits, h)
+			sort.Slice(rerankCandidates, func(i, j int) bool { return rerankCandidates[i].Score > rerankCandidates[j].Score })
+			hits = rerankCandidates
 		}
-		rows.Close()
 
-		if len(hits) == 0 {
-			return mcp.NewToolResultText("No relevant documents found."), nil
+		if len(hits) > limit {
+			hits = hits[:limit]
 		}
+		resultCount.WithLabelValues("rag-search").Observe(float64(len(hits)))
 
-		// C. Fetch parent documents (deduplicated)
+		// D. Fetch parent documents (deduplicated)
 		type ParentDoc struct {
 			ID       string
 			Content  string
@@ -184,30 +447,41 @@ func main() {
 		}
 		parentCache := make(map[string]*ParentDoc)
 
-		sqlParent := `
-			SELECT id, content, metadata
-			FROM documents
-			WHERE id = $1`
-
-		for _, hit := range hits {
-			if _, exists := parentCache[hit.ParentID]; exists {
-				continue
-			}
-			var p ParentDoc
-			var metadataJSON []byte
-			err := pool.QueryRow(ctx, sqlParent, hit.ParentID).Scan(&p.ID, &p.Content, &metadataJSON)
-			if err != nil {
-				log.Printf("Error fetching parent %s: %v", hit.ParentID, err)
-				continue
-			}
-			if err := json.Unmarshal(metadataJSON, &p.Metadata); err != nil {
-				log.Printf("Error parsing parent metadata %s: %v", hit.ParentID, err)
-				continue
+		// Parent rows belong to the same tenant as their children, but we still
+		// scope this in its own tenant transaction rather than trust that.
+		err = withTenantTx(ctx, pool, tenantID, func(tx pgx.Tx) error {
+			parentCtx, parentSpan := tracer.Start(ctx, "db.parent_fetch")
+			defer parentSpan.End()
+
+			sqlParent := `
+				SELECT id, content, metadata
+				FROM documents
+				WHERE id = $1`
+
+			for _, hit := range hits {
+				if _, exists := parentCache[hit.ParentID]; exists {
+					continue
+				}
+				var p ParentDoc
+				var metadataJSON []byte
+				err := tx.QueryRow(parentCtx, sqlParent, hit.ParentID).Scan(&p.ID, &p.Content, &metadataJSON)
+				if err != nil {
+					log.Printf("Error fetching parent %s: %v", hit.ParentID, err)
+					continue
+				}
+				if err := json.Unmarshal(metadataJSON, &p.Metadata); err != nil {
+					log.Printf("Error parsing parent metadata %s: %v", hit.ParentID, err)
+					continue
+				}
+				parentCache[hit.ParentID] = &p
 			}
-			parentCache[hit.ParentID] = &p
+			return nil
+		})
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
 		}
 
-		// D. Build output — parent content for LLM context, child metadata for deep links
+		// E. Build output — parent content for LLM context, child metadata for deep links
 		var finalOutput strings.Builder
 
 		for _, hit := range hits {
@@ -236,20 +510,21 @@ func main() {
 		}
 
 		return mcp.NewToolResultText(finalOutput.String()), nil
-	})
+	}))
 
-	// Middleware to extract X-Tenant-ID and inject into Context
-	authMiddleware := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			tenantID := r.Header.Get("X-Tenant-ID")
-
-			// Optional: Fail early if header is missing, or let the tool handle it.
-			// Here we pass it through.
-			ctx := context.WithValue(r.Context(), TenantIDKey, tenantID)
+	// Define the 'rag-upsert' and 'rag-delete' ingestion tools
+	registerIngestTools(s, pool, embedder, limiter)
 
-			next.ServeHTTP(w, r.WithContext(ctx))
-		})
+	// Tenant auth middleware. The tenant always comes from a verified JWT
+	// claim (X-Tenant-ID is checked against it, not trusted on its own); a
+	// deployment without JWT_JWKS_URL configured fails at startup below
+	// rather than silently trusting a client-supplied header.
+	jwtKeyfunc, err := jwtKeyfuncFromEnv(context.Background())
+	if err != nil {
+		log.Fatalf("Unable to initialize JWT verification: %v", err)
 	}
+	log.Println("JWT_JWKS_URL configured: verifying bearer tokens and enforcing tenant claim.")
+	authMiddleware := jwtTenantMiddleware(jwtKeyfunc)
 
 	// 6. Set up Streamable HTTP Server (SSE) with Middleware
 	// We need a public URL for the client (LibreChat) to reach the messages endpoint.
@@ -272,8 +547,10 @@ func main() {
 			start := time.Now()
 			log.Printf("Received %s request for %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
 
-			// Log headers
-			log.Printf("Headers: %v", r.Header)
+			// Log headers, with the bearer JWT (and any other auth-bearing
+			// header) redacted: it carries the caller's tenant claim and
+			// shouldn't land in plaintext server logs.
+			log.Printf("Headers: %v", redactedHeaders(r.Header))
 
 			next.ServeHTTP(w, r)
 
@@ -294,8 +571,8 @@ func main() {
 
 	// 7. Start HTTP Server
 	mux := http.NewServeMux()
-	mux.Handle("/sse", loggingMiddleware(authMiddleware(sseServer.SSEHandler())))
-	mux.Handle("/messages", loggingMiddleware(authMiddleware(sseServer.MessageHandler()))) // Streamable HTTP requires a messages endpoint
+	mux.Handle("/sse", tracingMiddleware(loggingMiddleware(authMiddleware(rateLimitMiddleware(limiter)(sseServer.SSEHandler())))))
+	mux.Handle("/messages", tracingMiddleware(loggingMiddleware(authMiddleware(rateLimitMiddleware(limiter)(sseServer.MessageHandler()))))) // Streamable HTTP requires a messages endpoint
 
 	// Health check endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -303,6 +580,9 @@ func main() {
 		w.Write([]byte("OK"))
 	})
 
+	// Prometheus metrics endpoint
+	mux.Handle("/metrics", promhttp.Handler())
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+const (
+	tenantLimitsRefreshInterval = 1 * time.Minute
+
+	// ipBucketIdleTTL bounds how long an unauthenticated IP's bucket is kept
+	// after its last request, so ipBkts doesn't grow without bound under
+	// sustained unauthenticated traffic from many distinct clients.
+	ipBucketIdleTTL = 10 * time.Minute
+
+	defaultTenantRPS              = 5.0
+	defaultTenantBurst            = 10
+	defaultDailyEmbeddingBudget   = 5000
+	defaultUnauthenticatedIPRPS   = 1.0
+	defaultUnauthenticatedIPBurst = 3
+)
+
+var (
+	rateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcp_rate_limit_rejections_total",
+		Help: "Requests rejected by the per-tenant/per-IP rate limiter.",
+	}, []string{"scope"})
+
+	embeddingBudgetRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcp_embedding_budget_rejections_total",
+		Help: "Tool calls rejected because a tenant exhausted its daily embedding budget.",
+	}, []string{"tenant_id"})
+
+	embeddingsCalledTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcp_embeddings_called_total",
+		Help: "Embedding API calls made, by tenant.",
+	}, []string{"tenant_id"})
+
+	searchesServedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcp_searches_served_total",
+		Help: "rag-search tool invocations served, by tenant.",
+	}, []string{"tenant_id"})
+
+	tokensBilledTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcp_tokens_billed_total",
+		Help: "Tokens billed by the embedding provider, by tenant. Exact where the provider reports usage, estimated otherwise.",
+	}, []string{"tenant_id"})
+)
+
+// tenantQuota is one row of the tenant_limits table, cached in memory.
+type tenantQuota struct {
+	RPS                  float64
+	Burst                int
+	DailyEmbeddingBudget int
+}
+
+// tenantRateLimiter enforces a token-bucket rate limit per tenant (falling
+// back to a per-IP bucket for unauthenticated requests) and tracks daily
+// embedding budget consumption. Quotas are loaded from the tenant_limits
+// table and refreshed periodically so operators don't need a restart to
+// change a tenant's limits.
+type tenantRateLimiter struct {
+	pool *pgxpool.Pool
+
+	mu           sync.Mutex
+	quotas       map[string]tenantQuota
+	tenantBkts   map[string]*rate.Limiter
+	ipBkts       map[string]*ipBucket
+	embeddingUse map[string]*dailyCounter
+}
+
+type dailyCounter struct {
+	day   string // YYYY-MM-DD, compared as a string to avoid a clock dependency here
+	count int
+}
+
+// ipBucket pairs an unauthenticated IP's limiter with the last time it was
+// used, so idle entries can be evicted instead of accumulating forever.
+type ipBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newTenantRateLimiter(pool *pgxpool.Pool) *tenantRateLimiter {
+	return &tenantRateLimiter{
+		pool:         pool,
+		quotas:       make(map[string]tenantQuota),
+		tenantBkts:   make(map[string]*rate.Limiter),
+		ipBkts:       make(map[string]*ipBucket),
+		embeddingUse: make(map[string]*dailyCounter),
+	}
+}
+
+// refreshLoop periodically reloads tenant_limits until ctx is cancelled. Run
+// it in its own goroutine from main.
+func (l *tenantRateLimiter) refreshLoop(ctx context.Context) {
+	l.refresh(ctx)
+	ticker := time.NewTicker(tenantLimitsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.refresh(ctx)
+		}
+	}
+}
+
+func (l *tenantRateLimiter) refresh(ctx context.Context) {
+	rows, err := l.pool.Query(ctx, `SELECT tenant_id, rps, burst, daily_embedding_budget FROM tenant_limits`)
+	if err != nil {
+		log.Printf("Error refreshing tenant_limits: %v", err)
+		l.mu.Lock()
+		l.evictIdleIPBuckets(time.Now())
+		l.mu.Unlock()
+		return
+	}
+	defer rows.Close()
+
+	quotas := make(map[string]tenantQuota)
+	for rows.Next() {
+		var tenantID string
+		var q tenantQuota
+		if err := rows.Scan(&tenantID, &q.RPS, &q.Burst, &q.DailyEmbeddingBudget); err != nil {
+			log.Printf("Error scanning tenant_limits row: %v", err)
+			continue
+		}
+		quotas[tenantID] = q
+	}
+
+	l.mu.Lock()
+	oldQuotas := l.quotas
+	l.quotas = quotas
+	// Only drop a tenant's cached bucket if its rps/burst actually changed
+	// (including going to/from the process defaults) between refreshes.
+	// Resetting unchanged tenants would hand them a fresh full burst every
+	// tenantLimitsRefreshInterval forever, which can dwarf their configured
+	// rate for a tenant deliberately throttled to a low rps.
+	for tenantID := range l.tenantBkts {
+		oldQuota, hadQuota := oldQuotas[tenantID]
+		newQuota, hasQuota := quotas[tenantID]
+		if hadQuota != hasQuota || oldQuota.RPS != newQuota.RPS || oldQuota.Burst != newQuota.Burst {
+			delete(l.tenantBkts, tenantID)
+		}
+	}
+	l.evictIdleIPBuckets(time.Now())
+	l.mu.Unlock()
+}
+
+// evictIdleIPBuckets drops ipBkts entries that haven't been used within
+// ipBucketIdleTTL of now. Must be called with l.mu held.
+func (l *tenantRateLimiter) evictIdleIPBuckets(now time.Time) {
+	for ip, bkt := range l.ipBkts {
+		if now.Sub(bkt.lastSeen) > ipBucketIdleTTL {
+			delete(l.ipBkts, ip)
+		}
+	}
+}
+
+// allowTenant reports whether a request for tenantID may proceed, creating
+// its bucket (from its configured quota, or the process defaults) on first use.
+func (l *tenantRateLimiter) allowTenant(tenantID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limiter, ok := l.tenantBkts[tenantID]
+	if !ok {
+		rps, burst := defaultTenantRPS, defaultTenantBurst
+		if q, ok := l.quotas[tenantID]; ok {
+			rps, burst = q.RPS, q.Burst
+		}
+		limiter = rate.NewLimiter(rate.Limit(rps), burst)
+		l.tenantBkts[tenantID] = limiter
+	}
+	return limiter.Allow()
+}
+
+// allowIP reports whether an unauthenticated request from ip may proceed.
+func (l *tenantRateLimiter) allowIP(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bkt, ok := l.ipBkts[ip]
+	if !ok {
+		bkt = &ipBucket{limiter: rate.NewLimiter(rate.Limit(defaultUnauthenticatedIPRPS), defaultUnauthenticatedIPBurst)}
+		l.ipBkts[ip] = bkt
+	}
+	bkt.lastSeen = time.Now()
+	return bkt.limiter.Allow()
+}
+
+// consumeEmbeddingBudget reports whether tenantID still has daily embedding
+// budget remaining, and if so decrements it. today is passed in (rather than
+// computed here) so callers control the clock dependency.
+func (l *tenantRateLimiter) consumeEmbeddingBudget(tenantID string, today string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	budget := defaultDailyEmbeddingBudget
+	if q, ok := l.quotas[tenantID]; ok {
+		budget = q.DailyEmbeddingBudget
+	}
+
+	counter, ok := l.embeddingUse[tenantID]
+	if !ok || counter.day != today {
+		counter = &dailyCounter{day: today}
+		l.embeddingUse[tenantID] = counter
+	}
+
+	if counter.count >= budget {
+		return false
+	}
+	counter.count++
+	return true
+}
+
+// rateLimitMiddleware enforces the token-bucket limits. It must run after
+// authMiddleware so TenantIDKey is already populated in the request context.
+func rateLimitMiddleware(limiter *tenantRateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenantID, _ := r.Context().Value(TenantIDKey).(string)
+
+			var allowed bool
+			scope := "tenant"
+			if tenantID != "" {
+				allowed = limiter.allowTenant(tenantID)
+			} else {
+				scope = "ip"
+				ip, _, err := net.SplitHostPort(r.RemoteAddr)
+				if err != nil {
+					ip = r.RemoteAddr
+				}
+				allowed = limiter.allowIP(ip)
+			}
+
+			if !allowed {
+				rateLimitRejections.WithLabelValues(scope).Inc()
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(r.Context()))
+		})
+	}
+}
+
+// embeddingBudgetError is returned by the rag-search handler, as a structured
+// MCP tool error, when a tenant has exhausted its daily embedding budget.
+func embeddingBudgetError(tenantID string) error {
+	embeddingBudgetRejections.WithLabelValues(tenantID).Inc()
+	return fmt.Errorf("daily embedding budget exhausted for tenant %s", tenantID)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Reranker scores (query, document) pairs with a cross-encoder, which is
+// slower but more precise than cosine similarity at telling a superficially
+// similar chunk apart from the one that actually answers the query.
+type Reranker interface {
+	// Rerank returns, for each document, a relevance score for the query.
+	// The i-th score corresponds to documents[i]; order of the input is
+	// preserved so callers can re-sort themselves.
+	Rerank(ctx context.Context, query string, documents []string) ([]float64, error)
+	Name() string
+}
+
+// newRerankerFromEnv selects a Reranker based on RERANKER_PROVIDER
+// ("cohere", "jina", or "bge"), using RERANKER_URL for the self-hosted "bge"
+// case. Returns (nil, nil) if RERANKER_PROVIDER is unset, since reranking is
+// opt-in per request via the `rerank` tool parameter.
+func newRerankerFromEnv() (Reranker, error) {
+	provider := os.Getenv("RERANKER_PROVIDER")
+	if provider == "" {
+		return nil, nil
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	switch provider {
+	case "cohere":
+		apiKey := os.Getenv("COHERE_API_KEY")
+		if apiKey == "" {
+			return nil, fmt.Errorf("COHERE_API_KEY is required when RERANKER_PROVIDER=cohere")
+		}
+		return &cohereReranker{apiKey: apiKey, model: "rerank-english-v3.0", httpClient: httpClient}, nil
+	case "jina":
+		apiKey := os.Getenv("JINA_API_KEY")
+		if apiKey == "" {
+			return nil, fmt.Errorf("JINA_API_KEY is required when RERANKER_PROVIDER=jina")
+		}
+		return &jinaReranker{apiKey: apiKey, model: "jina-reranker-v2-base-multilingual", httpClient: httpClient}, nil
+	case "bge":
+		url := os.Getenv("RERANKER_URL")
+		if url == "" {
+			return nil, fmt.Errorf("RERANKER_URL is required when RERANKER_PROVIDER=bge")
+		}
+		return &bgeReranker{url: url, httpClient: httpClient}, nil
+	default:
+		return nil, fmt.Errorf("unknown RERANKER_PROVIDER %q: must be one of cohere, jina, bge", provider)
+	}
+}
+
+// cohereReranker calls Cohere's /v1/rerank endpoint.
+type cohereReranker struct {
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+func (r *cohereReranker) Rerank(ctx context.Context, query string, documents []string) ([]float64, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model":     r.model,
+		"query":     query,
+		"documents": documents,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.cohere.com/v1/rerank", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cohere rerank request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("cohere rerank returned %d: %s", resp.StatusCode, string(b))
+	}
+
+	var parsed struct {
+		Results []struct {
+			Index          int     `json:"index"`
+			RelevanceScore float64 `json:"relevance_score"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("decoding cohere rerank response: %w", err)
+	}
+
+	scores := make([]float64, len(documents))
+	for _, result := range parsed.Results {
+		if result.Index >= 0 && result.Index < len(scores) {
+			scores[result.Index] = result.RelevanceScore
+		}
+	}
+	return scores, nil
+}
+
+func (r *cohereReranker) Name() string { return "cohere/" + r.model }
+
+// jinaReranker calls Jina AI's /v1/rerank endpoint, which mirrors Cohere's
+// request/response shape closely enough to share the parsing logic.
+type jinaReranker struct {
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+func (r *jinaReranker) Rerank(ctx context.Context, query string, documents []string) ([]float64, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model":     r.model,
+		"query":     query,
+		"documents": documents,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.jina.ai/v1/rerank", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("jina rerank request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("jina rerank returned %d: %s", resp.StatusCode, string(b))
+	}
+
+	var parsed struct {
+		Results []struct {
+			Index          int     `json:"index"`
+			RelevanceScore float64 `json:"relevance_score"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("decoding jina rerank response: %w", err)
+	}
+
+	scores := make([]float64, len(documents))
+	for _, result := range parsed.Results {
+		if result.Index >= 0 && result.Index < len(scores) {
+			scores[result.Index] = result.RelevanceScore
+		}
+	}
+	return scores, nil
+}
+
+func (r *jinaReranker) Name() string { return "jina/" + r.model }
+
+// bgeReranker calls a self-hosted BGE-reranker HTTP endpoint. The expected
+// contract is a simple {query, documents} in, {scores: []float64} out —
+// matching the common FastAPI wrappers used to serve BGE-reranker locally.
+type bgeReranker struct {
+	url        string
+	httpClient *http.Client
+}
+
+func (r *bgeReranker) Rerank(ctx context.Context, query string, documents []string) ([]float64, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"query":     query,
+		"documents": documents,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("bge rerank request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("bge rerank returned %d: %s", resp.StatusCode, string(b))
+	}
+
+	var parsed struct {
+		Scores []float64 `json:"scores"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("decoding bge rerank response: %w", err)
+	}
+	if len(parsed.Scores) != len(documents) {
+		return nil, fmt.Errorf("bge rerank returned %d scores for %d documents", len(parsed.Scores), len(documents))
+	}
+	return parsed.Scores, nil
+}
+
+func (r *bgeReranker) Name() string { return "bge" }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is shared by the HTTP middleware, the rag-search handler, and the
+// pgx query tracer so every span in a request lands in the same trace.
+var tracer = otel.Tracer("go-mcp-server")
+
+// setupOTel wires up an OTLP/gRPC trace exporter following the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT (and friends) env conventions. Tracing is
+// disabled — spans become no-ops — if the endpoint isn't set, so this is
+// safe to call unconditionally.
+func setupOTel(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(ctx, resource.WithAttributes(
+		semconv.ServiceName("go-mcp-server"),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return tp.Shutdown, nil
+}
+
+// tracingMiddleware extracts an incoming `traceparent` header (if present)
+// and starts a span for the HTTP request, so a trace started by the client
+// continues through our handler instead of starting a new one.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "http."+r.Method+" "+r.URL.Path)
+		defer span.End()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+var (
+	toolInvocationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcp_tool_invocations_total",
+		Help: "MCP tool invocations, by tool, tenant, and status (ok|error).",
+	}, []string{"tool", "tenant_id", "status"})
+
+	toolLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mcp_tool_latency_seconds",
+		Help:    "MCP tool handler latency.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"tool"})
+
+	embeddingLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mcp_embedding_latency_seconds",
+		Help:    "Embedding provider call latency.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider"})
+
+	dbQueryLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mcp_db_query_latency_seconds",
+		Help:    "Database query latency, by operation (select/insert/update/delete).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	resultCount = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mcp_search_result_count",
+		Help:    "Number of results returned by rag-search.",
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 50},
+	}, []string{"tool"})
+
+	pgxPoolAcquireWaitSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mcp_pgx_pool_acquire_wait_seconds_total",
+		Help: "Cumulative time pgxpool connection acquires have spent waiting, as reported by pool.Stat().",
+	})
+)
+
+// instrumentTool wraps a tool handler with an OTel span plus the
+// mcp_tool_invocations_total / mcp_tool_latency_seconds metrics, so every
+// registered tool gets the same observability for free.
+func instrumentTool(toolName string, handler server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		start := time.Now()
+		tenantID := tenantIDFromRequest(ctx, request)
+
+		ctx, span := tracer.Start(ctx, toolName, trace.WithAttributes(
+			attribute.String("mcp.tenant_id", tenantID),
+		))
+		defer span.End()
+
+		result, err := handler(ctx, request)
+
+		status := "ok"
+		if err != nil || (result != nil && result.IsError) {
+			status = "error"
+			span.SetStatus(codes.Error, toolName+" returned an error")
+		}
+		toolInvocationsTotal.WithLabelValues(toolName, tenantID, status).Inc()
+		toolLatencySeconds.WithLabelValues(toolName).Observe(time.Since(start).Seconds())
+
+		return result, err
+	}
+}
+
+// pollPoolStats periodically copies pgxpool.Stat()'s cumulative acquire wait
+// time into a Prometheus gauge, until ctx is cancelled. pgxpool doesn't
+// expose a per-acquire tracer hook, so polling the cumulative stat is the
+// simplest way to surface acquire wait time without forking the driver.
+func pollPoolStats(ctx context.Context, pool *pgxpool.Pool) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pgxPoolAcquireWaitSeconds.Set(pool.Stat().AcquireDuration().Seconds())
+		}
+	}
+}
+
+// otelQueryTracer implements pgx.QueryTracer, creating a span (and recording
+// a Prometheus latency observation) around every query so slow SQL shows up
+// in traces next to the rag-search span that triggered it.
+type otelQueryTracer struct{}
+
+type otelQueryTracerCtxKey struct{}
+
+type otelQuerySpanState struct {
+	span      trace.Span
+	start     time.Time
+	operation string
+}
+
+func (t *otelQueryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	operation := sqlOperation(data.SQL)
+	ctx, span := tracer.Start(ctx, "db."+operation,
+		trace.WithAttributes(attribute.String("db.statement", data.SQL)))
+
+	return context.WithValue(ctx, otelQueryTracerCtxKey{}, &otelQuerySpanState{
+		span:      span,
+		start:     time.Now(),
+		operation: operation,
+	})
+}
+
+func (t *otelQueryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	state, ok := ctx.Value(otelQueryTracerCtxKey{}).(*otelQuerySpanState)
+	if !ok {
+		return
+	}
+	defer state.span.End()
+
+	dbQueryLatencySeconds.WithLabelValues(state.operation).Observe(time.Since(state.start).Seconds())
+
+	if data.Err != nil {
+		state.span.RecordError(data.Err)
+		state.span.SetStatus(codes.Error, data.Err.Error())
+	}
+}
+
+// sqlOperation returns a low-cardinality label (select/insert/update/delete/other)
+// from the leading keyword of a SQL statement.
+func sqlOperation(sql string) string {
+	trimmed := strings.TrimSpace(sql)
+	firstWord := strings.ToLower(strings.SplitN(trimmed, " ", 2)[0])
+	switch firstWord {
+	case "select", "insert", "update", "delete":
+		return firstWord
+	default:
+		return "other"
+	}
+}